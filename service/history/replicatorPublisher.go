@@ -0,0 +1,192 @@
+// The MIT License
+//
+// Copyright (c) 2020 Temporal Technologies Inc.  All rights reserved.
+//
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"fmt"
+	"sync"
+
+	replicationspb "go.temporal.io/server/api/replication/v1"
+	"go.temporal.io/server/common/messaging"
+)
+
+// ReplicationPublisher is the transport-agnostic sink replicatorQueueProcessorImpl
+// publishes replication tasks to. Kafka is the only production implementation
+// today, but the interface exists so a remote cluster can instead be fed by a
+// gRPC stream, or, for tests and disaster-recovery dumps, by an in-memory
+// sink -- without replicatorQueueProcessorImpl knowing which one it's talking to.
+type ReplicationPublisher interface {
+	// Publish delivers a single replication task. Implementations decide
+	// their own delivery semantics (e.g. Kafka's at-least-once).
+	Publish(task *replicationspb.ReplicationTask) error
+	// Name identifies the publisher for logging and health reporting, e.g.
+	// "kafka", "grpc-stream:<cluster>", "in-memory".
+	Name() string
+	// Healthy reports whether the publisher's last attempt succeeded, so the
+	// reconciliation scheduler can back off a failing transport without
+	// stalling the shared queue.
+	Healthy() bool
+}
+
+// kafkaReplicationPublisher adapts the existing messaging.Producer dependency
+// (today, a Kafka producer) to ReplicationPublisher.
+type kafkaReplicationPublisher struct {
+	producer messaging.Producer
+
+	mu        sync.Mutex
+	lastError error
+}
+
+func newKafkaReplicationPublisher(producer messaging.Producer) *kafkaReplicationPublisher {
+	return &kafkaReplicationPublisher{producer: producer}
+}
+
+func (p *kafkaReplicationPublisher) Publish(task *replicationspb.ReplicationTask) error {
+	err := p.producer.Publish(task)
+	p.mu.Lock()
+	p.lastError = err
+	p.mu.Unlock()
+	return err
+}
+
+func (p *kafkaReplicationPublisher) Name() string {
+	return "kafka"
+}
+
+func (p *kafkaReplicationPublisher) Healthy() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastError == nil
+}
+
+// inMemoryReplicationPublisher buffers published tasks instead of sending
+// them anywhere. It backs unit tests and can also serve as a
+// disaster-recovery dump target: point it at a namespace under migration and
+// later replay Tasks() through a real publisher.
+type inMemoryReplicationPublisher struct {
+	mu    sync.Mutex
+	tasks []*replicationspb.ReplicationTask
+}
+
+func newInMemoryReplicationPublisher() *inMemoryReplicationPublisher {
+	return &inMemoryReplicationPublisher{}
+}
+
+func (p *inMemoryReplicationPublisher) Publish(task *replicationspb.ReplicationTask) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tasks = append(p.tasks, task)
+	return nil
+}
+
+func (p *inMemoryReplicationPublisher) Name() string {
+	return "in-memory"
+}
+
+func (p *inMemoryReplicationPublisher) Healthy() bool {
+	return true
+}
+
+// Tasks returns every task published so far, in publish order.
+func (p *inMemoryReplicationPublisher) Tasks() []*replicationspb.ReplicationTask {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tasks := make([]*replicationspb.ReplicationTask, len(p.tasks))
+	copy(tasks, p.tasks)
+	return tasks
+}
+
+// grpcStreamReplicationPublisher will deliver tasks by streaming them to a
+// remote frontend, matching the pull-based xDC direction, once that client is
+// generated in this tree. It is not wired up yet: the grpc client stub this
+// publisher would call lives in a package this snapshot doesn't include.
+type grpcStreamReplicationPublisher struct {
+	clusterName string
+}
+
+func newGRPCStreamReplicationPublisher(clusterName string) *grpcStreamReplicationPublisher {
+	return &grpcStreamReplicationPublisher{clusterName: clusterName}
+}
+
+func (p *grpcStreamReplicationPublisher) Publish(task *replicationspb.ReplicationTask) error {
+	return fmt.Errorf("grpc stream replication publisher for cluster %q is not implemented in this build", p.clusterName)
+}
+
+func (p *grpcStreamReplicationPublisher) Name() string {
+	return "grpc-stream:" + p.clusterName
+}
+
+func (p *grpcStreamReplicationPublisher) Healthy() bool {
+	return false
+}
+
+// fanOutReplicationPublisher publishes to every member publisher, used for
+// dual-write during a migration between transports. Publish returns an error
+// if any member fails, but still attempts every member rather than
+// short-circuiting, so a single bad transport doesn't block delivery to the
+// others.
+type fanOutReplicationPublisher struct {
+	publishers []ReplicationPublisher
+}
+
+func newFanOutReplicationPublisher(publishers ...ReplicationPublisher) *fanOutReplicationPublisher {
+	return &fanOutReplicationPublisher{publishers: publishers}
+}
+
+func (p *fanOutReplicationPublisher) Publish(task *replicationspb.ReplicationTask) error {
+	var firstErr error
+	for _, publisher := range p.publishers {
+		if err := publisher.Publish(task); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("publisher %q: %w", publisher.Name(), err)
+		}
+	}
+	return firstErr
+}
+
+func (p *fanOutReplicationPublisher) Name() string {
+	return "fan-out"
+}
+
+// Healthy reports whether every member publisher is healthy. The scheduler
+// backs off the whole fan-out if any single transport is failing, since a
+// dual-write migration is only safe once both sides are caught up.
+func (p *fanOutReplicationPublisher) Healthy() bool {
+	for _, publisher := range p.publishers {
+		if !publisher.Healthy() {
+			return false
+		}
+	}
+	return true
+}
+
+// HealthByName reports each member publisher's health, keyed by Name(), so
+// callers can tell which specific transport is backing off.
+func (p *fanOutReplicationPublisher) HealthByName() map[string]bool {
+	health := make(map[string]bool, len(p.publishers))
+	for _, publisher := range p.publishers {
+		health[publisher.Name()] = publisher.Healthy()
+	}
+	return health
+}
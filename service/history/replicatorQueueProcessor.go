@@ -0,0 +1,560 @@
+// The MIT License
+//
+// Copyright (c) 2020 Temporal Technologies Inc.  All rights reserved.
+//
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	commonpb "go.temporal.io/api/common/v1"
+	"go.temporal.io/api/serviceerror"
+
+	enumsspb "go.temporal.io/server/api/enums/v1"
+	historyspb "go.temporal.io/server/api/history/v1"
+	persistencespb "go.temporal.io/server/api/persistence/v1"
+	replicationspb "go.temporal.io/server/api/replication/v1"
+	"go.temporal.io/server/common"
+	"go.temporal.io/server/common/log"
+	"go.temporal.io/server/common/log/tag"
+	"go.temporal.io/server/common/messaging"
+	"go.temporal.io/server/common/persistence"
+)
+
+// replicationTaskHistoryPageSize bounds a single ReadRawHistoryBranch call
+// while building a history replication task. It is generous on purpose: a
+// task's [FirstEventId, NextEventId) range is whatever one write appended, so
+// in practice this almost always fits a single page.
+const replicationTaskHistoryPageSize = 1000
+
+// maxTrackedReplicationExecutions bounds replicatorQueueProcessorImpl.executions.
+// A shard processes replication tasks for the life of the process, so without
+// a cap the map would grow forever; once it's full, recordExecution evicts
+// terminal (Completed/Failed) entries in the order they were recorded as
+// terminal, never the ones still Pending/InProgress.
+const maxTrackedReplicationExecutions = 10000
+
+var (
+	errUnexpectedQueueTask    = errors.New("unexpected queue task type for replicator queue processor")
+	errUnknownReplicationTask = errors.New("unknown replication task type")
+)
+
+type (
+	replicatorQueueProcessorImpl struct {
+		currentClusterName string
+		shard              ShardContext
+		historyCache       *historyCache
+		// publisher is the transport replication tasks are handed to. It
+		// starts out wrapping whatever messaging.Producer the caller passed
+		// to newReplicatorQueueProcessor (Kafka in production, a mock in
+		// tests) and can be widened into a fan-out via AddPublisher.
+		publisher    ReplicationPublisher
+		executionMgr persistence.ExecutionManager
+		historyV2Mgr persistence.HistoryV2Manager
+		logger       log.Logger
+
+		// executions tracks admin-visible state for replication tasks this
+		// processor has handled, keyed by TaskId, so operators can introspect
+		// in-flight work without reaching into persistence directly. It is
+		// bounded by maxTrackedReplicationExecutions; see
+		// evictOldestTerminalLocked.
+		executionsMu sync.RWMutex
+		executions   map[int64]*ReplicationExecutionInfo
+		// terminalOrder records a TaskId each time it reaches a terminal
+		// (Completed/Failed) status, oldest first, so
+		// evictOldestTerminalLocked can evict in that order instead of
+		// scanning the whole map. A task that reached a terminal status more
+		// than once is evicted by its earliest record.
+		terminalOrder []int64
+
+		// scheduler runs the periodic reconciliation sweep; see
+		// replicationReconciliationScheduler for what it does and does not
+		// detect.
+		scheduler *replicationReconciliationScheduler
+
+		// triggerLimiters rate-limits EVENT and SCHEDULED tasks independently
+		// so a reconciliation sweep can never starve live replication
+		// traffic. MANUAL tasks have no entry and bypass rate limiting
+		// entirely; see replicationTrigger's doc comments.
+		triggerLimiters map[replicationTrigger]*triggerLimiter
+	}
+
+	// ReplicatorQueueProcessor drives replication task processing for a shard
+	// and exposes introspection of the tasks it has handled.
+	ReplicatorQueueProcessor interface {
+		Start()
+		Stop()
+
+		process(taskInfo *taskInfo) (int, error)
+		getTask(taskID int64) (*persistencespb.ReplicationTaskInfo, error)
+
+		ListReplicationExecutions(request *ListReplicationExecutionsRequest) (*ListReplicationExecutionsResponse, error)
+		GetReplicationExecution(taskID int64) (*ReplicationExecutionInfo, error)
+		StopReplicationExecution(taskID int64, reason string) error
+	}
+
+	// ReplicationExecutionInfo is the admin-facing view of a single
+	// replication task's lifecycle, surfaced through ListReplicationExecutions
+	// and GetReplicationExecution.
+	ReplicationExecutionInfo struct {
+		TaskId      int64
+		TaskType    enumsspb.TaskType
+		NamespaceId string
+		WorkflowId  string
+		RunId       string
+		Trigger     replicationTrigger
+		Status      ReplicationExecutionStatus
+		Attempt     int32
+		LastError   string
+		UpdateTime  time.Time
+	}
+
+	// ReplicationExecutionStatus describes where a replication task is in its
+	// processing lifecycle.
+	ReplicationExecutionStatus int32
+
+	// ListReplicationExecutionsRequest paginates over the in-flight and
+	// recently completed replication executions tracked by this shard's
+	// processor.
+	ListReplicationExecutionsRequest struct {
+		NamespaceId       string
+		SourceTaskIdStart int64
+		SourceTaskIdEnd   int64
+		PageSize          int
+		NextPageToken     []byte
+	}
+
+	// ListReplicationExecutionsResponse is the paginated result of
+	// ListReplicationExecutions. TotalCount reflects the full matching set,
+	// not just the current page, mirroring the count-plus-token pagination
+	// used elsewhere in the admin API.
+	ListReplicationExecutionsResponse struct {
+		Executions    []*ReplicationExecutionInfo
+		NextPageToken []byte
+		TotalCount    int
+	}
+)
+
+const (
+	// ReplicationExecutionStatusPending means the task has not yet been picked up by the processor.
+	ReplicationExecutionStatusPending ReplicationExecutionStatus = iota
+	// ReplicationExecutionStatusInProgress means the task is currently being processed.
+	ReplicationExecutionStatusInProgress
+	// ReplicationExecutionStatusCompleted means the task finished and was acked.
+	ReplicationExecutionStatusCompleted
+	// ReplicationExecutionStatusFailed means the task's last processing attempt returned an error.
+	ReplicationExecutionStatusFailed
+)
+
+var _ ReplicatorQueueProcessor = (*replicatorQueueProcessorImpl)(nil)
+
+func newReplicatorQueueProcessor(
+	shard ShardContext,
+	historyCache *historyCache,
+	replicatorMessageSink messaging.Producer,
+	executionMgr persistence.ExecutionManager,
+	historyV2Mgr persistence.HistoryV2Manager,
+	logger log.Logger,
+) ReplicatorQueueProcessor {
+	p := &replicatorQueueProcessorImpl{
+		currentClusterName: shard.GetClusterMetadata().GetCurrentClusterName(),
+		shard:              shard,
+		historyCache:       historyCache,
+		publisher:          newKafkaReplicationPublisher(replicatorMessageSink),
+		executionMgr:       executionMgr,
+		historyV2Mgr:       historyV2Mgr,
+		logger:             log.With(logger, tag.ComponentReplicatorQueue),
+		executions:         make(map[int64]*ReplicationExecutionInfo),
+		triggerLimiters:    newDefaultTriggerLimiters(),
+	}
+	p.scheduler = newReplicationReconciliationScheduler(shard, p, p.logger)
+	return p
+}
+
+func (p *replicatorQueueProcessorImpl) Start() {
+	p.scheduler.Start()
+}
+
+func (p *replicatorQueueProcessorImpl) Stop() {
+	p.scheduler.Stop()
+}
+
+// AddPublisher widens the processor's publisher into a fan-out that also
+// writes to the given publisher, supporting dual-write during a migration
+// between transports (e.g. Kafka to a gRPC stream). Calling it more than
+// once keeps adding members to the same fan-out.
+func (p *replicatorQueueProcessorImpl) AddPublisher(publisher ReplicationPublisher) {
+	if fanOut, ok := p.publisher.(*fanOutReplicationPublisher); ok {
+		fanOut.publishers = append(fanOut.publishers, publisher)
+		return
+	}
+	p.publisher = newFanOutReplicationPublisher(p.publisher, publisher)
+}
+
+func (p *replicatorQueueProcessorImpl) process(taskInfo *taskInfo) (int, error) {
+	wrapper, trigger, ok := unwrapReplicationTask(taskInfo.task)
+	if !ok {
+		return 0, errUnexpectedQueueTask
+	}
+	replicationTask := wrapper.ReplicationTaskInfo
+
+	if limiter, ok := p.triggerLimiters[trigger]; ok && !limiter.Allow() {
+		return 0, errReplicationTaskThrottled
+	}
+
+	p.logger.Debug("processing replication task",
+		tag.TaskID(replicationTask.TaskId),
+		tag.NewStringTag("trigger", trigger.String()),
+		tag.NewInt("trigger-priority", triggerPriority(trigger)),
+	)
+
+	p.recordExecution(replicationTask, trigger, ReplicationExecutionStatusInProgress, "")
+
+	var err error
+	switch replicationTask.TaskType {
+	case enumsspb.TASK_TYPE_REPLICATION_SYNC_ACTIVITY:
+		err = p.processSyncActivityTask(replicationTask)
+	case enumsspb.TASK_TYPE_REPLICATION_HISTORY:
+		err = p.processHistoryReplicationTask(replicationTask)
+	default:
+		err = errUnknownReplicationTask
+	}
+
+	if err != nil {
+		p.recordExecution(replicationTask, trigger, ReplicationExecutionStatusFailed, err.Error())
+		return 0, err
+	}
+
+	if err := p.executionMgr.CompleteReplicationTask(&persistence.CompleteReplicationTaskRequest{
+		TaskID: replicationTask.TaskId,
+	}); err != nil {
+		p.recordExecution(replicationTask, trigger, ReplicationExecutionStatusFailed, err.Error())
+		return 0, err
+	}
+
+	p.recordExecution(replicationTask, trigger, ReplicationExecutionStatusCompleted, "")
+	return 0, nil
+}
+
+func (p *replicatorQueueProcessorImpl) processSyncActivityTask(task *persistencespb.ReplicationTaskInfo) error {
+	weContext, release, err := p.historyCache.getOrCreateWorkflowExecutionForBackground(
+		task.NamespaceId,
+		commonpb.WorkflowExecution{
+			WorkflowId: task.WorkflowId,
+			RunId:      task.RunId,
+		},
+	)
+	if err != nil {
+		if _, ok := err.(*serviceerror.NotFound); ok {
+			return nil
+		}
+		return err
+	}
+	defer func() { release(err) }()
+
+	mutableState, err := weContext.loadWorkflowExecution()
+	if err != nil {
+		if _, ok := err.(*serviceerror.NotFound); ok {
+			return nil
+		}
+		return err
+	}
+
+	if !mutableState.IsWorkflowExecutionRunning() {
+		return nil
+	}
+
+	activityInfo, ok := mutableState.GetActivityInfo(task.ScheduledId)
+	if !ok {
+		return nil
+	}
+
+	versionHistories := mutableState.GetExecutionInfo().VersionHistories
+	currentVersionHistory := versionHistories.Histories[versionHistories.CurrentVersionHistoryIndex]
+
+	replicationTask := &replicationspb.ReplicationTask{
+		SourceTaskId: task.TaskId,
+		TaskType:     enumsspb.REPLICATION_TASK_TYPE_SYNC_ACTIVITY_TASK,
+		Attributes: &replicationspb.ReplicationTask_SyncActivityTaskAttributes{
+			SyncActivityTaskAttributes: &replicationspb.SyncActivityTaskAttributes{
+				NamespaceId:        task.NamespaceId,
+				WorkflowId:         task.WorkflowId,
+				RunId:              task.RunId,
+				Version:            activityInfo.Version,
+				ScheduledId:        activityInfo.ScheduleId,
+				ScheduledTime:      activityInfo.ScheduledTime,
+				StartedId:          activityInfo.StartedId,
+				StartedTime:        activityInfo.StartedTime,
+				LastHeartbeatTime:  activityInfo.LastHeartbeatUpdateTime,
+				Details:            activityInfo.LastHeartbeatDetails,
+				Attempt:            activityInfo.Attempt,
+				LastFailure:        activityInfo.RetryLastFailure,
+				LastWorkerIdentity: activityInfo.RetryLastWorkerIdentity,
+				VersionHistory:     currentVersionHistory,
+			},
+		},
+	}
+
+	return p.publisher.Publish(replicationTask)
+}
+
+// processHistoryReplicationTask reads the [FirstEventId, NextEventId) range
+// task.BranchToken points at and publishes it as a HistoryTaskV2Attributes
+// replication task. Events are forwarded as the same raw DataBlob bytes
+// ReadRawHistoryBranch returns rather than deserialized and re-encoded, since
+// a remote cluster's history store persists the identical bytes we read here.
+func (p *replicatorQueueProcessorImpl) processHistoryReplicationTask(task *persistencespb.ReplicationTaskInfo) error {
+	eventsBlob, err := p.getEventsBlob(task.BranchToken, task.FirstEventId, task.NextEventId)
+	if err != nil {
+		return err
+	}
+
+	var newRunEventsBlob *commonpb.DataBlob
+	if len(task.NewRunBranchToken) > 0 {
+		newRunEventsBlob, err = p.getEventsBlob(task.NewRunBranchToken, common.FirstEventID, common.FirstEventID+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	return p.publisher.Publish(&replicationspb.ReplicationTask{
+		SourceTaskId: task.TaskId,
+		TaskType:     enumsspb.REPLICATION_TASK_TYPE_HISTORY_V2_TASK,
+		Attributes: &replicationspb.ReplicationTask_HistoryTaskV2Attributes{
+			HistoryTaskV2Attributes: &replicationspb.HistoryTaskV2Attributes{
+				TaskId:      task.TaskId,
+				NamespaceId: task.NamespaceId,
+				WorkflowId:  task.WorkflowId,
+				RunId:       task.RunId,
+				VersionHistoryItems: []*historyspb.VersionHistoryItem{
+					{EventId: task.NextEventId - 1, Version: task.Version},
+				},
+				Events:       eventsBlob,
+				NewRunEvents: newRunEventsBlob,
+			},
+		},
+	})
+}
+
+// getEventsBlob reads [firstEventID, nextEventID) off a history branch and
+// returns the first raw event blob of the first page; further blobs in that
+// page and further pages are not returned. It is a thin wrapper around
+// historyV2Mgr.ReadRawHistoryBranch so processHistoryReplicationTask and its
+// new-run-events call share one error-handling path.
+func (p *replicatorQueueProcessorImpl) getEventsBlob(branchToken []byte, firstEventID, nextEventID int64) (*commonpb.DataBlob, error) {
+	resp, err := p.historyV2Mgr.ReadRawHistoryBranch(&persistence.ReadHistoryBranchRequest{
+		BranchToken: branchToken,
+		MinEventID:  firstEventID,
+		MaxEventID:  nextEventID,
+		PageSize:    replicationTaskHistoryPageSize,
+		ShardID:     p.shard.GetShardID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.HistoryEventBlobs) == 0 {
+		return nil, serviceerror.NewInternal("replication task references an empty history range")
+	}
+	return resp.HistoryEventBlobs[0], nil
+}
+
+func (p *replicatorQueueProcessorImpl) getTask(taskID int64) (*persistencespb.ReplicationTaskInfo, error) {
+	resp, err := p.executionMgr.GetReplicationTasks(&persistence.GetReplicationTasksRequest{
+		MinTaskID: taskID,
+		MaxTaskID: taskID,
+		BatchSize: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Tasks) == 0 {
+		return nil, serviceerror.NewNotFound("replication task not found")
+	}
+	return resp.Tasks[0], nil
+}
+
+// recordExecution updates the admin-visible snapshot for a single replication
+// task. It is intentionally best-effort: a failure to observe a task here
+// never affects the actual replication path.
+func (p *replicatorQueueProcessorImpl) recordExecution(
+	task *persistencespb.ReplicationTaskInfo,
+	trigger replicationTrigger,
+	status ReplicationExecutionStatus,
+	lastError string,
+) {
+	p.executionsMu.Lock()
+	defer p.executionsMu.Unlock()
+
+	info, ok := p.executions[task.TaskId]
+	if !ok {
+		info = &ReplicationExecutionInfo{
+			TaskId:      task.TaskId,
+			TaskType:    task.TaskType,
+			NamespaceId: task.NamespaceId,
+			WorkflowId:  task.WorkflowId,
+			RunId:       task.RunId,
+			Trigger:     trigger,
+		}
+		p.executions[task.TaskId] = info
+	}
+	// process() calls recordExecution twice per pass: once with
+	// InProgress when it picks the task up, once with the terminal
+	// Completed/Failed status. Attempt counts passes, so it only
+	// increments on the InProgress call -- otherwise a single successful
+	// pass would report Attempt == 2 and every retry would add 2.
+	if status == ReplicationExecutionStatusInProgress {
+		info.Attempt++
+	}
+	info.Status = status
+	info.LastError = lastError
+	info.UpdateTime = time.Now().UTC()
+
+	if status == ReplicationExecutionStatusCompleted || status == ReplicationExecutionStatusFailed {
+		p.terminalOrder = append(p.terminalOrder, task.TaskId)
+	}
+	p.evictOldestTerminalLocked()
+}
+
+// evictOldestTerminalLocked drops terminal executions, oldest-terminal-first,
+// until executions is back at or under maxTrackedReplicationExecutions.
+// Pending/InProgress entries are never evicted -- the processor is still
+// actively working them. Callers must hold executionsMu for writing.
+func (p *replicatorQueueProcessorImpl) evictOldestTerminalLocked() {
+	for len(p.executions) > maxTrackedReplicationExecutions && len(p.terminalOrder) > 0 {
+		taskID := p.terminalOrder[0]
+		p.terminalOrder = p.terminalOrder[1:]
+
+		info, ok := p.executions[taskID]
+		if !ok || (info.Status != ReplicationExecutionStatusCompleted && info.Status != ReplicationExecutionStatusFailed) {
+			continue
+		}
+		delete(p.executions, taskID)
+	}
+}
+
+// ListReplicationExecutions returns a page of replication executions known to
+// this shard's processor, optionally filtered by namespace and source task id
+// range. Results are ordered by TaskId ascending.
+func (p *replicatorQueueProcessorImpl) ListReplicationExecutions(
+	request *ListReplicationExecutionsRequest,
+) (*ListReplicationExecutionsResponse, error) {
+	p.executionsMu.RLock()
+	defer p.executionsMu.RUnlock()
+
+	pageSize := request.PageSize
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+	start := request.SourceTaskIdStart
+	if len(request.NextPageToken) == 8 {
+		start = int64(binary.BigEndian.Uint64(request.NextPageToken))
+	}
+
+	matched := make([]*ReplicationExecutionInfo, 0, len(p.executions))
+	totalCount := 0
+	for taskID, info := range p.executions {
+		if request.NamespaceId != "" && info.NamespaceId != request.NamespaceId {
+			continue
+		}
+		if taskID < request.SourceTaskIdStart {
+			continue
+		}
+		if request.SourceTaskIdEnd > 0 && taskID > request.SourceTaskIdEnd {
+			continue
+		}
+		totalCount++
+		if taskID < start {
+			continue
+		}
+		matched = append(matched, info)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].TaskId < matched[j].TaskId
+	})
+
+	response := &ListReplicationExecutionsResponse{TotalCount: totalCount}
+	if len(matched) > pageSize {
+		response.Executions = matched[:pageSize]
+		token := make([]byte, 8)
+		binary.BigEndian.PutUint64(token, uint64(matched[pageSize].TaskId))
+		response.NextPageToken = token
+	} else {
+		response.Executions = matched
+	}
+	return response, nil
+}
+
+// GetReplicationExecution returns the admin-visible state for a single
+// replication task, or NotFound if this shard's processor has not observed it.
+func (p *replicatorQueueProcessorImpl) GetReplicationExecution(taskID int64) (*ReplicationExecutionInfo, error) {
+	p.executionsMu.RLock()
+	defer p.executionsMu.RUnlock()
+
+	info, ok := p.executions[taskID]
+	if !ok {
+		return nil, serviceerror.NewNotFound("replication execution not found")
+	}
+	return info, nil
+}
+
+// StopReplicationExecution marks a tracked, not yet completed replication
+// execution as failed in the admin-visible view. It changes only that view:
+// a pass already running is not interrupted, and process() does not consult
+// this state, so the task is processed again if it is handed to process()
+// once more.
+func (p *replicatorQueueProcessorImpl) StopReplicationExecution(taskID int64, reason string) error {
+	p.executionsMu.Lock()
+	defer p.executionsMu.Unlock()
+
+	info, ok := p.executions[taskID]
+	if !ok {
+		return serviceerror.NewNotFound("replication execution not found")
+	}
+	if info.Status == ReplicationExecutionStatusCompleted {
+		return serviceerror.NewInvalidArgument("replication execution already completed")
+	}
+	info.Status = ReplicationExecutionStatusFailed
+	info.LastError = reason
+	info.UpdateTime = time.Now().UTC()
+	p.terminalOrder = append(p.terminalOrder, taskID)
+	p.evictOldestTerminalLocked()
+	return nil
+}
+
+// ResendReplicationTask processes a single replication task on behalf of an
+// operator (e.g. a targeted resend for a stuck runId), tagged with
+// replicationTriggerManual. Manual tasks have no entry in triggerLimiters, so
+// this bypasses rate limiting entirely, and are run synchronously here rather
+// than waiting to be popped off the normal queue, so they are never ordered
+// behind routine EVENT or SCHEDULED traffic.
+func (p *replicatorQueueProcessorImpl) ResendReplicationTask(task *persistencespb.ReplicationTaskInfo) (int, error) {
+	wrapper := &triggeredReplicationTask{
+		ReplicationTaskInfoWrapper: &persistence.ReplicationTaskInfoWrapper{ReplicationTaskInfo: task},
+		trigger:                    replicationTriggerManual,
+	}
+	return p.process(newTaskInfo(nil, wrapper, p.logger))
+}
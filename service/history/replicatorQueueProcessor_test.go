@@ -30,6 +30,7 @@ import (
 
 	"github.com/golang/mock/gomock"
 	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
 	commonpb "go.temporal.io/api/common/v1"
@@ -482,3 +483,421 @@ func (s *replicatorQueueProcessorSuite) TestSyncActivity_ActivityRunning() {
 	_, err := s.replicatorQueueProcessor.process(newTaskInfo(nil, wrapper, s.logger))
 	s.Nil(err)
 }
+
+func (s *replicatorQueueProcessorSuite) TestHistoryReplicationTask_PublishesEventsFromBranch() {
+	namespaceID := testNamespaceID
+	workflowID := "some random workflow ID"
+	runID := uuid.New()
+	taskID := int64(5678)
+	firstEventID := int64(10)
+	nextEventID := int64(14)
+	version := int64(9)
+	branchToken := []byte("some random branch token")
+
+	task := &persistencespb.ReplicationTaskInfo{
+		TaskType:     enumsspb.TASK_TYPE_REPLICATION_HISTORY,
+		TaskId:       taskID,
+		NamespaceId:  namespaceID,
+		WorkflowId:   workflowID,
+		RunId:        runID,
+		FirstEventId: firstEventID,
+		NextEventId:  nextEventID,
+		Version:      version,
+		BranchToken:  branchToken,
+	}
+	s.mockExecutionMgr.On("CompleteReplicationTask", &persistence.CompleteReplicationTaskRequest{TaskID: taskID}).Return(nil).Once()
+
+	eventsBlob := &commonpb.DataBlob{Data: []byte("some random serialized events")}
+	s.mockHistoryV2Mgr.On("ReadRawHistoryBranch", &persistence.ReadHistoryBranchRequest{
+		BranchToken: branchToken,
+		MinEventID:  firstEventID,
+		MaxEventID:  nextEventID,
+		PageSize:    replicationTaskHistoryPageSize,
+		ShardID:     s.replicatorQueueProcessor.shard.GetShardID(),
+	}).Return(&persistence.ReadRawHistoryBranchResponse{
+		HistoryEventBlobs: []*commonpb.DataBlob{eventsBlob},
+	}, nil).Once()
+
+	s.mockProducer.On("Publish", &replicationspb.ReplicationTask{
+		SourceTaskId: taskID,
+		TaskType:     enumsspb.REPLICATION_TASK_TYPE_HISTORY_V2_TASK,
+		Attributes: &replicationspb.ReplicationTask_HistoryTaskV2Attributes{
+			HistoryTaskV2Attributes: &replicationspb.HistoryTaskV2Attributes{
+				TaskId:      taskID,
+				NamespaceId: namespaceID,
+				WorkflowId:  workflowID,
+				RunId:       runID,
+				VersionHistoryItems: []*historyspb.VersionHistoryItem{
+					{EventId: nextEventID - 1, Version: version},
+				},
+				Events: eventsBlob,
+			},
+		},
+	}).Return(nil).Once()
+
+	wrapper := &persistence.ReplicationTaskInfoWrapper{ReplicationTaskInfo: task}
+	_, err := s.replicatorQueueProcessor.process(newTaskInfo(nil, wrapper, s.logger))
+	s.Nil(err)
+}
+
+func (s *replicatorQueueProcessorSuite) TestHistoryReplicationTask_EmptyBranchIsNotAcked() {
+	namespaceID := testNamespaceID
+	workflowID := "some random workflow ID"
+	runID := uuid.New()
+	taskID := int64(5679)
+	branchToken := []byte("some random branch token")
+
+	task := &persistencespb.ReplicationTaskInfo{
+		TaskType:     enumsspb.TASK_TYPE_REPLICATION_HISTORY,
+		TaskId:       taskID,
+		NamespaceId:  namespaceID,
+		WorkflowId:   workflowID,
+		RunId:        runID,
+		FirstEventId: 10,
+		NextEventId:  11,
+		BranchToken:  branchToken,
+	}
+
+	s.mockHistoryV2Mgr.On("ReadRawHistoryBranch", mock.Anything).Return(&persistence.ReadRawHistoryBranchResponse{}, nil).Once()
+
+	wrapper := &persistence.ReplicationTaskInfoWrapper{ReplicationTaskInfo: task}
+	_, err := s.replicatorQueueProcessor.process(newTaskInfo(nil, wrapper, s.logger))
+	s.Error(err, "an empty history range must not be silently acked as Completed")
+	s.mockExecutionMgr.AssertNotCalled(s.T(), "CompleteReplicationTask", mock.Anything)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (s *replicatorQueueProcessorSuite) TestReconciliationScheduler_RunSweepIsDeterministic() {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	s.replicatorQueueProcessor.scheduler.setClock(clock)
+
+	gapCount, err := s.replicatorQueueProcessor.scheduler.runSweep(clock.Now())
+	s.NoError(err)
+	s.Equal(0, gapCount)
+}
+
+func (s *replicatorQueueProcessorSuite) TestReconciliationScheduler_RunSweepRespectsPerNamespaceInterval() {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	scheduler := s.replicatorQueueProcessor.scheduler
+	scheduler.setClock(clock)
+
+	namespaceID := testNamespaceID
+	scheduler.SetNamespaceConfig(namespaceID, ReplicationReconciliationConfig{
+		Interval:       time.Minute,
+		LookbackWindow: time.Hour,
+		Concurrency:    5,
+	})
+
+	gapCount, err := scheduler.runSweep(clock.now)
+	s.NoError(err)
+	s.Equal(0, gapCount)
+	firstRun, ok := scheduler.lastRun[namespaceID]
+	s.True(ok, "a due namespace should be recorded as swept")
+
+	// Still well within the configured one-minute interval: the namespace
+	// is not due again, so lastRun must not advance.
+	clock.now = clock.now.Add(time.Second)
+	_, err = scheduler.runSweep(clock.now)
+	s.NoError(err)
+	s.Equal(firstRun, scheduler.lastRun[namespaceID])
+
+	// Past the interval: the namespace is due again.
+	clock.now = clock.now.Add(time.Minute)
+	_, err = scheduler.runSweep(clock.now)
+	s.NoError(err)
+	s.Equal(clock.now, scheduler.lastRun[namespaceID])
+}
+
+func (s *replicatorQueueProcessorSuite) TestReconciliationScheduler_RunSweepBacksOffWhenPublisherUnhealthy() {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	scheduler := s.replicatorQueueProcessor.scheduler
+	scheduler.setClock(clock)
+
+	namespaceID := testNamespaceID
+	scheduler.SetNamespaceConfig(namespaceID, ReplicationReconciliationConfig{
+		Interval:       time.Minute,
+		LookbackWindow: time.Hour,
+		Concurrency:    5,
+	})
+
+	s.replicatorQueueProcessor.publisher = newGRPCStreamReplicationPublisher(cluster.TestAlternativeClusterName)
+
+	gapCount, err := scheduler.runSweep(clock.Now())
+	s.NoError(err)
+	s.Equal(0, gapCount)
+	_, swept := scheduler.lastRun[namespaceID]
+	s.False(swept, "a namespace must not be marked swept while its publisher is unhealthy")
+
+	s.replicatorQueueProcessor.publisher = newInMemoryReplicationPublisher()
+	_, err = scheduler.runSweep(clock.Now())
+	s.NoError(err)
+	_, swept = scheduler.lastRun[namespaceID]
+	s.True(swept, "the sweep resumes as soon as the publisher recovers")
+}
+
+func (s *replicatorQueueProcessorSuite) TestTriggerLimiters_RateLimitIsolatedPerTrigger() {
+	scheduledLimiter := s.replicatorQueueProcessor.triggerLimiters[replicationTriggerScheduled]
+	eventLimiter := s.replicatorQueueProcessor.triggerLimiters[replicationTriggerEvent]
+
+	s.True(scheduledLimiter.Allow())
+	s.False(scheduledLimiter.Allow(), "scheduled lane has burst 1 and should throttle on the second call")
+	s.True(eventLimiter.Allow(), "event lane has its own budget and is unaffected by the scheduled lane throttling")
+
+	_, manualHasLimiter := s.replicatorQueueProcessor.triggerLimiters[replicationTriggerManual]
+	s.False(manualHasLimiter, "manual tasks bypass rate limiting entirely")
+}
+
+func (s *replicatorQueueProcessorSuite) TestTriggerPriority_ManualBeforeEventBeforeScheduled() {
+	s.True(triggerPriority(replicationTriggerManual) < triggerPriority(replicationTriggerEvent))
+	s.True(triggerPriority(replicationTriggerEvent) < triggerPriority(replicationTriggerScheduled))
+}
+
+func (s *replicatorQueueProcessorSuite) TestInMemoryReplicationPublisher_BuffersPublishedTasks() {
+	publisher := newInMemoryReplicationPublisher()
+	task := &replicationspb.ReplicationTask{SourceTaskId: 42}
+
+	s.NoError(publisher.Publish(task))
+	s.Equal([]*replicationspb.ReplicationTask{task}, publisher.Tasks())
+	s.True(publisher.Healthy())
+}
+
+func (s *replicatorQueueProcessorSuite) TestFanOutReplicationPublisher_PublishesToEveryMember() {
+	first := newInMemoryReplicationPublisher()
+	second := newInMemoryReplicationPublisher()
+	fanOut := newFanOutReplicationPublisher(first, second)
+
+	task := &replicationspb.ReplicationTask{SourceTaskId: 7}
+	s.NoError(fanOut.Publish(task))
+
+	s.Equal([]*replicationspb.ReplicationTask{task}, first.Tasks())
+	s.Equal([]*replicationspb.ReplicationTask{task}, second.Tasks())
+	s.True(fanOut.Healthy())
+}
+
+func (s *replicatorQueueProcessorSuite) TestFanOutReplicationPublisher_UnhealthyMemberMarksFanOutUnhealthy() {
+	healthy := newInMemoryReplicationPublisher()
+	unhealthy := newGRPCStreamReplicationPublisher(cluster.TestAlternativeClusterName)
+	fanOut := newFanOutReplicationPublisher(healthy, unhealthy)
+
+	s.False(fanOut.Healthy())
+	s.Equal(map[string]bool{"in-memory": true, unhealthy.Name(): false}, fanOut.HealthByName())
+}
+
+func (s *replicatorQueueProcessorSuite) TestAddPublisher_WidensIntoFanOut() {
+	extra := newInMemoryReplicationPublisher()
+	s.replicatorQueueProcessor.AddPublisher(extra)
+
+	fanOut, ok := s.replicatorQueueProcessor.publisher.(*fanOutReplicationPublisher)
+	s.True(ok)
+	s.Len(fanOut.publishers, 2)
+}
+
+func (s *replicatorQueueProcessorSuite) TestProcess_ManualTriggerBypassesScheduledThrottle() {
+	namespaceID := testNamespaceID
+	workflowID := "some random workflow ID"
+	runID := uuid.New()
+	taskID := int64(9001)
+
+	// Exhaust the SCHEDULED lane's single token of burst.
+	scheduledLimiter := s.replicatorQueueProcessor.triggerLimiters[replicationTriggerScheduled]
+	s.True(scheduledLimiter.Allow())
+
+	scheduledTask := &triggeredReplicationTask{
+		ReplicationTaskInfoWrapper: &persistence.ReplicationTaskInfoWrapper{
+			ReplicationTaskInfo: &persistencespb.ReplicationTaskInfo{
+				TaskType:    enumsspb.TASK_TYPE_REPLICATION_SYNC_ACTIVITY,
+				TaskId:      taskID,
+				NamespaceId: namespaceID,
+				WorkflowId:  workflowID,
+				RunId:       runID,
+			},
+		},
+		trigger: replicationTriggerScheduled,
+	}
+	_, err := s.replicatorQueueProcessor.process(newTaskInfo(nil, scheduledTask, s.logger))
+	s.Equal(errReplicationTaskThrottled, err)
+
+	// A MANUAL task against the same workflow is not subject to the
+	// SCHEDULED lane's limiter and is processed immediately.
+	s.mockExecutionMgr.On("CompleteReplicationTask", &persistence.CompleteReplicationTaskRequest{TaskID: taskID}).Return(nil).Once()
+	s.mockExecutionMgr.On("GetWorkflowExecution", &persistence.GetWorkflowExecutionRequest{
+		NamespaceID: namespaceID,
+		Execution: commonpb.WorkflowExecution{
+			WorkflowId: workflowID,
+			RunId:      runID,
+		},
+	}).Return(nil, serviceerror.NewNotFound(""))
+	s.mockNamespaceCache.EXPECT().GetNamespaceByID(namespaceID).Return(cache.NewGlobalNamespaceCacheEntryForTest(
+		&persistencespb.NamespaceInfo{Id: namespaceID, Name: "some random namespace name"},
+		&persistencespb.NamespaceConfig{Retention: timestamp.DurationFromDays(1)},
+		&persistencespb.NamespaceReplicationConfig{
+			ActiveClusterName: cluster.TestCurrentClusterName,
+			Clusters: []string{
+				cluster.TestCurrentClusterName,
+				cluster.TestAlternativeClusterName,
+			},
+		},
+		1234,
+		nil,
+	), nil).AnyTimes()
+
+	_, err = s.replicatorQueueProcessor.ResendReplicationTask(&persistencespb.ReplicationTaskInfo{
+		TaskType:    enumsspb.TASK_TYPE_REPLICATION_SYNC_ACTIVITY,
+		TaskId:      taskID,
+		NamespaceId: namespaceID,
+		WorkflowId:  workflowID,
+		RunId:       runID,
+	})
+	s.NoError(err)
+
+	info, err := s.replicatorQueueProcessor.GetReplicationExecution(taskID)
+	s.NoError(err)
+	s.Equal(replicationTriggerManual, info.Trigger)
+}
+
+func (s *replicatorQueueProcessorSuite) TestRecordExecution_AttemptCountsPassesNotStatusUpdates() {
+	namespace := "some random namespace name"
+	namespaceID := testNamespaceID
+	workflowID := "some random workflow ID"
+	runID := uuid.New()
+	taskID := int64(5555)
+	task := &persistencespb.ReplicationTaskInfo{
+		TaskType:    enumsspb.TASK_TYPE_REPLICATION_SYNC_ACTIVITY,
+		TaskId:      taskID,
+		NamespaceId: namespaceID,
+		WorkflowId:  workflowID,
+		RunId:       runID,
+	}
+	s.mockExecutionMgr.On("CompleteReplicationTask", &persistence.CompleteReplicationTaskRequest{TaskID: taskID}).Return(nil).Once()
+	s.mockExecutionMgr.On("GetWorkflowExecution", &persistence.GetWorkflowExecutionRequest{
+		NamespaceID: namespaceID,
+		Execution: commonpb.WorkflowExecution{
+			WorkflowId: workflowID,
+			RunId:      runID,
+		},
+	}).Return(nil, serviceerror.NewNotFound(""))
+	s.mockNamespaceCache.EXPECT().GetNamespaceByID(namespaceID).Return(cache.NewGlobalNamespaceCacheEntryForTest(
+		&persistencespb.NamespaceInfo{Id: namespaceID, Name: namespace},
+		&persistencespb.NamespaceConfig{Retention: timestamp.DurationFromDays(1)},
+		&persistencespb.NamespaceReplicationConfig{
+			ActiveClusterName: cluster.TestCurrentClusterName,
+			Clusters: []string{
+				cluster.TestCurrentClusterName,
+				cluster.TestAlternativeClusterName,
+			},
+		},
+		1234,
+		nil,
+	), nil).AnyTimes()
+
+	wrapper := &persistence.ReplicationTaskInfoWrapper{ReplicationTaskInfo: task}
+	_, err := s.replicatorQueueProcessor.process(newTaskInfo(nil, wrapper, s.logger))
+	s.NoError(err)
+
+	info, err := s.replicatorQueueProcessor.GetReplicationExecution(taskID)
+	s.NoError(err)
+	s.Equal(int32(1), info.Attempt, "a single successful pass should count as exactly one attempt")
+	s.Equal(ReplicationExecutionStatusCompleted, info.Status)
+}
+
+func (s *replicatorQueueProcessorSuite) TestListReplicationExecutions_FiltersByNamespaceAndPaginates() {
+	p := s.replicatorQueueProcessor
+	for i := int64(1); i <= 5; i++ {
+		namespaceID := testNamespaceID
+		if i == 5 {
+			namespaceID = "other-namespace"
+		}
+		p.recordExecution(&persistencespb.ReplicationTaskInfo{
+			TaskId:      i,
+			NamespaceId: namespaceID,
+		}, replicationTriggerEvent, ReplicationExecutionStatusCompleted, "")
+	}
+
+	resp, err := p.ListReplicationExecutions(&ListReplicationExecutionsRequest{
+		NamespaceId: testNamespaceID,
+		PageSize:    2,
+	})
+	s.NoError(err)
+	s.Equal(4, resp.TotalCount, "4 of the 5 recorded executions belong to the requested namespace")
+	s.Len(resp.Executions, 2)
+	s.Equal(int64(1), resp.Executions[0].TaskId)
+	s.Equal(int64(2), resp.Executions[1].TaskId)
+	s.NotEmpty(resp.NextPageToken)
+
+	next, err := p.ListReplicationExecutions(&ListReplicationExecutionsRequest{
+		NamespaceId:   testNamespaceID,
+		PageSize:      2,
+		NextPageToken: resp.NextPageToken,
+	})
+	s.NoError(err)
+	s.Equal(int64(3), next.Executions[0].TaskId)
+	s.Equal(int64(4), next.Executions[1].TaskId)
+}
+
+func (s *replicatorQueueProcessorSuite) TestRecordExecution_EvictsOldestTerminalEntriesPastCap() {
+	p := s.replicatorQueueProcessor
+
+	// One still-InProgress task, recorded first: it must survive eviction
+	// even though it's the oldest entry, since it's not terminal.
+	p.recordExecution(&persistencespb.ReplicationTaskInfo{TaskId: 0, NamespaceId: testNamespaceID}, replicationTriggerEvent, ReplicationExecutionStatusInProgress, "")
+
+	for i := int64(1); i <= maxTrackedReplicationExecutions; i++ {
+		p.recordExecution(&persistencespb.ReplicationTaskInfo{TaskId: i, NamespaceId: testNamespaceID}, replicationTriggerEvent, ReplicationExecutionStatusCompleted, "")
+	}
+
+	s.Len(p.executions, maxTrackedReplicationExecutions, "the map must never grow past its cap")
+	_, stillTracked := p.executions[0]
+	s.True(stillTracked, "a Pending/InProgress entry is never evicted")
+	_, stillTracked = p.executions[1]
+	s.False(stillTracked, "the oldest terminal entry is evicted first")
+	_, stillTracked = p.executions[maxTrackedReplicationExecutions]
+	s.True(stillTracked, "the newest terminal entry survives")
+}
+
+func (s *replicatorQueueProcessorSuite) TestGetReplicationExecution_NotFound() {
+	_, err := s.replicatorQueueProcessor.GetReplicationExecution(int64(424242))
+	s.Error(err)
+	s.IsType(&serviceerror.NotFound{}, err)
+}
+
+func (s *replicatorQueueProcessorSuite) TestStopReplicationExecution_MarksInProgressTaskFailed() {
+	p := s.replicatorQueueProcessor
+	taskID := int64(777)
+	p.recordExecution(&persistencespb.ReplicationTaskInfo{
+		TaskId:      taskID,
+		NamespaceId: testNamespaceID,
+	}, replicationTriggerEvent, ReplicationExecutionStatusInProgress, "")
+
+	s.NoError(p.StopReplicationExecution(taskID, "operator cancelled"))
+
+	info, err := p.GetReplicationExecution(taskID)
+	s.NoError(err)
+	s.Equal(ReplicationExecutionStatusFailed, info.Status)
+	s.Equal("operator cancelled", info.LastError)
+}
+
+func (s *replicatorQueueProcessorSuite) TestStopReplicationExecution_RejectsAlreadyCompletedTask() {
+	p := s.replicatorQueueProcessor
+	taskID := int64(778)
+	p.recordExecution(&persistencespb.ReplicationTaskInfo{
+		TaskId:      taskID,
+		NamespaceId: testNamespaceID,
+	}, replicationTriggerEvent, ReplicationExecutionStatusCompleted, "")
+
+	err := p.StopReplicationExecution(taskID, "too late")
+	s.Error(err)
+	s.IsType(&serviceerror.InvalidArgument{}, err)
+}
+
+func (s *replicatorQueueProcessorSuite) TestStopReplicationExecution_NotFound() {
+	err := s.replicatorQueueProcessor.StopReplicationExecution(int64(424243), "does not exist")
+	s.Error(err)
+	s.IsType(&serviceerror.NotFound{}, err)
+}
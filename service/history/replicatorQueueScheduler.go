@@ -0,0 +1,398 @@
+// The MIT License
+//
+// Copyright (c) 2020 Temporal Technologies Inc.  All rights reserved.
+//
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	enumsspb "go.temporal.io/server/api/enums/v1"
+	persistencespb "go.temporal.io/server/api/persistence/v1"
+	"go.temporal.io/server/common/log"
+	"go.temporal.io/server/common/log/tag"
+	"go.temporal.io/server/common/metrics"
+	"go.temporal.io/server/common/persistence"
+)
+
+type (
+	// replicationReconciliationScheduler periodically sweeps active workflows
+	// whose VersionHistories tail is ahead of the last published replication
+	// checkpoint and re-enqueues SYNC_ACTIVITY / history-range tasks to cover
+	// the gap. It exists to recover from tasks that were lost, acked
+	// prematurely, or that a remote cluster asked to have resent, none of
+	// which the reactive queue processor would otherwise notice.
+	//
+	// In this build the sweep detects no gaps: findReplicationGaps inspects
+	// no workflow and returns an empty result, so no task is re-enqueued.
+	// The scheduling, per-namespace intervals and publisher backoff around
+	// it do run.
+	replicationReconciliationScheduler struct {
+		shard     ShardContext
+		processor *replicatorQueueProcessorImpl
+		clock     clock
+		logger    log.Logger
+		metrics   metrics.Client
+
+		status     int32
+		shutdownCh chan struct{}
+		shutdownWG sync.WaitGroup
+
+		configMu sync.RWMutex
+		configs  map[string]ReplicationReconciliationConfig
+
+		// lastRun tracks, per namespace, the last time that namespace's sweep
+		// actually ran, so runSweep can honor each namespace's own Interval
+		// instead of sweeping everything on a single shared tick.
+		lastRunMu sync.Mutex
+		lastRun   map[string]time.Time
+
+		// gapScanWarned tracks which namespaces findReplicationGaps has
+		// already logged its "not implemented" Warn for, so that warning
+		// fires once per namespace instead of once per sweep forever.
+		warnMu        sync.Mutex
+		gapScanWarned map[string]bool
+	}
+
+	// ReplicationReconciliationConfig is the namespace-scoped knob set for the
+	// reconciliation sweep. It is read on every tick, so an update made
+	// through SetNamespaceConfig takes effect without a restart. Nothing in
+	// this package reads it from dynamic config.
+	ReplicationReconciliationConfig struct {
+		// Interval is how often the sweep runs for a namespace.
+		Interval time.Duration
+		// LookbackWindow bounds how far back the sweep looks for a gap,
+		// so a namespace with a very old checkpoint doesn't trigger an
+		// unbounded re-enqueue.
+		LookbackWindow time.Duration
+		// Concurrency caps how many workflows this namespace's sweep will
+		// inspect concurrently.
+		Concurrency int
+	}
+
+	// clock is the minimal time source the scheduler depends on, so tests can
+	// substitute a fake clock and drive ticks deterministically instead of
+	// sleeping in real time.
+	clock interface {
+		Now() time.Time
+	}
+
+	realClock struct{}
+)
+
+func (realClock) Now() time.Time { return time.Now().UTC() }
+
+const (
+	schedulerStatusStopped int32 = iota
+	schedulerStatusRunning
+)
+
+var defaultReplicationReconciliationConfig = ReplicationReconciliationConfig{
+	Interval:       5 * time.Minute,
+	LookbackWindow: 24 * time.Hour,
+	Concurrency:    10,
+}
+
+// schedulerTickInterval is how often sweepLoop wakes up to check whether any
+// configured namespace is due for a sweep. It is independent of, and always
+// shorter than, any single namespace's ReplicationReconciliationConfig.Interval
+// so per-namespace intervals (set via SetNamespaceConfig) are honored rather
+// than a single hardcoded cadence.
+const schedulerTickInterval = time.Second
+
+func newReplicationReconciliationScheduler(
+	shard ShardContext,
+	processor *replicatorQueueProcessorImpl,
+	logger log.Logger,
+) *replicationReconciliationScheduler {
+	return &replicationReconciliationScheduler{
+		shard:         shard,
+		processor:     processor,
+		clock:         realClock{},
+		logger:        log.With(logger, tag.ComponentReplicatorQueue),
+		metrics:       shard.GetMetricsClient(),
+		shutdownCh:    make(chan struct{}),
+		configs:       make(map[string]ReplicationReconciliationConfig),
+		lastRun:       make(map[string]time.Time),
+		gapScanWarned: make(map[string]bool),
+	}
+}
+
+// setClock overrides the scheduler's time source. It exists so tests can
+// drive reconciliation ticks deterministically instead of depending on wall
+// clock time.
+func (s *replicationReconciliationScheduler) setClock(c clock) {
+	s.clock = c
+}
+
+// configFor returns the effective reconciliation config for a namespace,
+// falling back to the package default when the namespace has not been
+// configured. SetNamespaceConfig can be called at any time, including while
+// the scheduler is running, to hot-reload an individual namespace's knobs.
+func (s *replicationReconciliationScheduler) configFor(namespaceID string) ReplicationReconciliationConfig {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	if cfg, ok := s.configs[namespaceID]; ok {
+		return cfg
+	}
+	return defaultReplicationReconciliationConfig
+}
+
+// SetNamespaceConfig updates the reconciliation knobs for a single namespace.
+func (s *replicationReconciliationScheduler) SetNamespaceConfig(namespaceID string, cfg ReplicationReconciliationConfig) {
+	s.configMu.Lock()
+	defer s.configMu.Unlock()
+
+	s.configs[namespaceID] = cfg
+}
+
+func (s *replicationReconciliationScheduler) Start() {
+	s.status = schedulerStatusRunning
+	s.shutdownWG.Add(1)
+	go s.sweepLoop()
+}
+
+func (s *replicationReconciliationScheduler) Stop() {
+	if s.status != schedulerStatusRunning {
+		return
+	}
+	s.status = schedulerStatusStopped
+	close(s.shutdownCh)
+	s.shutdownWG.Wait()
+}
+
+func (s *replicationReconciliationScheduler) sweepLoop() {
+	defer s.shutdownWG.Done()
+
+	ticker := time.NewTicker(schedulerTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.shutdownCh:
+			return
+		case <-ticker.C:
+			s.runSweep(s.clock.Now())
+		}
+	}
+}
+
+// runSweep is the deterministic, injectable half of the scheduler. For every
+// namespace with a ReplicationReconciliationConfig (set via
+// SetNamespaceConfig) that is due -- i.e. at least cfg.Interval has passed
+// since its last sweep -- it looks for a gap between the namespace's
+// workflows' VersionHistories tail and the last published replication
+// checkpoint, and re-enqueues a reconciliation task for each gap it finds.
+// It is unexported so package tests can call it directly with a fixed `now`
+// instead of waiting on a real ticker.
+//
+// Before touching any namespace, it checks the processor's publisher: if the
+// transport a reconciliation task would be re-enqueued onto is unhealthy, the
+// whole sweep backs off and returns without marking any namespace's lastRun,
+// so the next tick retries immediately once the transport recovers instead of
+// the namespace waiting out an unrelated full Interval. This is deliberately
+// a sweep-wide check rather than per-gap: there's no gap yet to re-enqueue
+// while scanning is unimplemented (see findReplicationGaps below), but the
+// check is in place so reEnqueueGap never has to push a task onto a publisher
+// it already knows is down.
+func (s *replicationReconciliationScheduler) runSweep(now time.Time) (int, error) {
+	namespaceIDs := s.configuredNamespaces()
+	if len(namespaceIDs) == 0 {
+		s.logger.Debug("replication reconciliation sweep has no namespaces configured, skipping")
+		return 0, nil
+	}
+
+	if !s.publisherHealthy() {
+		s.logger.Warn("replication reconciliation sweep backing off: publisher unhealthy",
+			tag.NewStringTag("publisher-health", fmt.Sprint(s.publisherHealthByName())))
+		return 0, nil
+	}
+
+	totalGaps := 0
+	for _, namespaceID := range namespaceIDs {
+		cfg := s.configFor(namespaceID)
+		if !s.dueFor(namespaceID, now, cfg.Interval) {
+			continue
+		}
+
+		gaps, err := s.findReplicationGaps(namespaceID, now, cfg)
+		if err != nil {
+			s.logger.Error("replication reconciliation sweep failed",
+				tag.Error(err), tag.WorkflowNamespaceID(namespaceID))
+			return totalGaps, err
+		}
+
+		for _, gap := range gaps {
+			if err := s.reEnqueueGap(gap); err != nil {
+				s.logger.Error("failed to re-enqueue replication gap",
+					tag.Error(err),
+					tag.WorkflowNamespaceID(gap.NamespaceID),
+					tag.WorkflowID(gap.WorkflowID),
+					tag.WorkflowRunID(gap.RunID),
+				)
+				continue
+			}
+			s.metrics.IncCounter(metrics.ReplicatorQueueProcessorScope, metrics.ReplicatorTaskCounterPerQueue)
+		}
+
+		s.markRun(namespaceID, now)
+		totalGaps += len(gaps)
+	}
+
+	return totalGaps, nil
+}
+
+// configuredNamespaces returns the namespace ids that have a
+// ReplicationReconciliationConfig set. Only these namespaces are swept:
+// without an explicit config, the reconciliation sweep has nothing to scope
+// its per-namespace interval/lookback/concurrency knobs to.
+func (s *replicationReconciliationScheduler) configuredNamespaces() []string {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+
+	namespaceIDs := make([]string, 0, len(s.configs))
+	for namespaceID := range s.configs {
+		namespaceIDs = append(namespaceIDs, namespaceID)
+	}
+	return namespaceIDs
+}
+
+// dueFor reports whether at least interval has passed since namespaceID's
+// last sweep, and is always true the first time a namespace is seen.
+func (s *replicationReconciliationScheduler) dueFor(namespaceID string, now time.Time, interval time.Duration) bool {
+	s.lastRunMu.Lock()
+	defer s.lastRunMu.Unlock()
+
+	last, ok := s.lastRun[namespaceID]
+	return !ok || now.Sub(last) >= interval
+}
+
+func (s *replicationReconciliationScheduler) markRun(namespaceID string, now time.Time) {
+	s.lastRunMu.Lock()
+	defer s.lastRunMu.Unlock()
+
+	s.lastRun[namespaceID] = now
+}
+
+// publisherHealthy reports whether the processor's publisher can currently
+// take a re-enqueued task. A fan-out counts as unhealthy if any one of its
+// members is, matching fanOutReplicationPublisher.Healthy's all-must-be-up
+// semantics for a dual-write migration.
+func (s *replicationReconciliationScheduler) publisherHealthy() bool {
+	return s.processor.publisher.Healthy()
+}
+
+// publisherHealthByName breaks the publisher's health down by transport, for
+// the backoff log line above. Non-fan-out publishers report a single entry
+// keyed by their own Name().
+func (s *replicationReconciliationScheduler) publisherHealthByName() map[string]bool {
+	if fanOut, ok := s.processor.publisher.(*fanOutReplicationPublisher); ok {
+		return fanOut.HealthByName()
+	}
+	return map[string]bool{s.processor.publisher.Name(): s.processor.publisher.Healthy()}
+}
+
+// replicationGap describes a single workflow whose replicated state has
+// fallen behind its VersionHistories tail by at least one event.
+type replicationGap struct {
+	NamespaceID   string
+	WorkflowID    string
+	RunID         string
+	CheckpointID  int64
+	TargetEventID int64
+}
+
+// findReplicationGaps scans namespaceID for workflows whose last published
+// replication checkpoint trails their current version history, bounded by
+// cfg.LookbackWindow and capped at cfg.Concurrency concurrent inspections.
+//
+// The full scan requires an ExecutionManager API to list open workflow
+// executions by namespace plus their last replication checkpoint, which this
+// snapshot of the persistence package does not expose. Rather than silently
+// reporting "zero gaps found" -- which an operator can't tell apart from a
+// real clean scan -- this logs once per namespace, the first time that
+// namespace is swept, that gap detection itself is not implemented yet.
+// Logging this on every due sweep forever (every Interval, per namespace)
+// would just be log spam for a condition that never changes once a build is
+// running, so later sweeps for an already-warned namespace log at Debug.
+func (s *replicationReconciliationScheduler) findReplicationGaps(
+	namespaceID string,
+	now time.Time,
+	cfg ReplicationReconciliationConfig,
+) ([]replicationGap, error) {
+	if s.shouldWarnGapScanUnimplemented(namespaceID) {
+		s.logger.Warn("replication reconciliation scan is not implemented in this build; no gaps will be detected",
+			tag.WorkflowNamespaceID(namespaceID),
+			tag.NewDurationTag("lookback-window", cfg.LookbackWindow),
+			tag.NewInt("concurrency", cfg.Concurrency),
+		)
+	} else {
+		s.logger.Debug("replication reconciliation scan skipped: not implemented in this build",
+			tag.WorkflowNamespaceID(namespaceID),
+		)
+	}
+	return nil, nil
+}
+
+// shouldWarnGapScanUnimplemented reports true the first time it's called for
+// a given namespace and false on every subsequent call, so
+// findReplicationGaps's Warn fires once per namespace instead of once per
+// sweep for the life of the process.
+func (s *replicationReconciliationScheduler) shouldWarnGapScanUnimplemented(namespaceID string) bool {
+	s.warnMu.Lock()
+	defer s.warnMu.Unlock()
+
+	if s.gapScanWarned[namespaceID] {
+		return false
+	}
+	s.gapScanWarned[namespaceID] = true
+	return true
+}
+
+// reEnqueueGap drives the gap straight through the processor as a
+// replicationTriggerScheduled task, the lowest-priority lane, rather than
+// writing a new row for the reactive queue to pick up later -- the sweep
+// already knows exactly which workflow fell behind, so there's no reason to
+// make it wait behind its own discovery. findReplicationGaps never produces
+// a gap in this snapshot of the tree (see its doc comment), so this is
+// unreachable today, but it runs the same path ResendReplicationTask (MANUAL)
+// uses so the SCHEDULED lane is wired, not just declared.
+func (s *replicationReconciliationScheduler) reEnqueueGap(gap replicationGap) error {
+	task := &triggeredReplicationTask{
+		ReplicationTaskInfoWrapper: &persistence.ReplicationTaskInfoWrapper{
+			ReplicationTaskInfo: &persistencespb.ReplicationTaskInfo{
+				TaskId:      gap.TargetEventID,
+				TaskType:    enumsspb.TASK_TYPE_REPLICATION_SYNC_ACTIVITY,
+				NamespaceId: gap.NamespaceID,
+				WorkflowId:  gap.WorkflowID,
+				RunId:       gap.RunID,
+			},
+		},
+		trigger: replicationTriggerScheduled,
+	}
+	_, err := s.processor.process(newTaskInfo(nil, task, s.logger))
+	return err
+}
@@ -0,0 +1,174 @@
+// The MIT License
+//
+// Copyright (c) 2020 Temporal Technologies Inc.  All rights reserved.
+//
+// Copyright (c) 2020 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package history
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"go.temporal.io/server/common/persistence"
+)
+
+// replicationTrigger identifies why a replication task was enqueued. It
+// mirrors what would ideally be a field on persistencespb.ReplicationTaskInfo
+// (see the note on triggeredReplicationTask below), and drives per-trigger rate limiting and
+// priority inside replicatorQueueProcessorImpl.
+type replicationTrigger int32
+
+const (
+	// replicationTriggerEvent is today's default: the task was produced by
+	// the history engine reacting to a workflow event, same as before this
+	// type existed.
+	replicationTriggerEvent replicationTrigger = iota
+	// replicationTriggerManual is an operator-initiated resend for a specific
+	// runId. Manual tasks bypass the normal queue ordering and rate limiting
+	// entirely so an operator's targeted resend is never starved by routine
+	// traffic.
+	replicationTriggerManual
+	// replicationTriggerScheduled comes from the reconciliation sweep
+	// (replicationReconciliationScheduler) and is deliberately the
+	// lowest-priority lane: it exists to backfill gaps, not to compete with
+	// live traffic.
+	replicationTriggerScheduled
+)
+
+func (t replicationTrigger) String() string {
+	switch t {
+	case replicationTriggerManual:
+		return "Manual"
+	case replicationTriggerScheduled:
+		return "Scheduled"
+	default:
+		return "Event"
+	}
+}
+
+var errReplicationTaskThrottled = errors.New("replication task throttled for its trigger lane")
+
+// triggeredReplicationTask pairs a persistence.ReplicationTaskInfoWrapper
+// with the replicationTrigger that produced it. persistencespb.ReplicationTaskInfo
+// itself has no Trigger field in this snapshot of the generated API package
+// -- it's proto-generated and that .proto isn't in this tree to regenerate
+// from -- so the trigger travels alongside the wrapper instead of inside it.
+// replicatorQueueProcessorImpl.ResendReplicationTask (MANUAL) and
+// replicationReconciliationScheduler.reEnqueueGap (SCHEDULED) both construct
+// one of these; a task that arrives as a plain
+// *persistence.ReplicationTaskInfoWrapper, i.e. everything popped off the
+// normal queue today, is treated as replicationTriggerEvent.
+type triggeredReplicationTask struct {
+	*persistence.ReplicationTaskInfoWrapper
+	trigger replicationTrigger
+}
+
+// unwrapReplicationTask extracts the persistence wrapper and the
+// replicationTrigger that produced a queue task, for use by process(). It
+// accepts both a bare *persistence.ReplicationTaskInfoWrapper (today's
+// default queue traffic, treated as replicationTriggerEvent) and a
+// *triggeredReplicationTask (an explicit MANUAL or SCHEDULED task). The
+// second return value is meaningless when ok is false.
+func unwrapReplicationTask(task interface{}) (*persistence.ReplicationTaskInfoWrapper, replicationTrigger, bool) {
+	switch t := task.(type) {
+	case *triggeredReplicationTask:
+		return t.ReplicationTaskInfoWrapper, t.trigger, true
+	case *persistence.ReplicationTaskInfoWrapper:
+		return t, replicationTriggerEvent, true
+	default:
+		return nil, replicationTriggerEvent, false
+	}
+}
+
+// triggerLimiter is a minimal token-bucket limiter scoped to a single
+// replicationTrigger. It is intentionally self-contained rather than pulling
+// in a shared rate limiter package, since each trigger's policy here is a
+// fixed burst/refill pair rather than something operators tune live.
+type triggerLimiter struct {
+	mu           sync.Mutex
+	tokens       float64
+	max          float64
+	refillPerSec float64
+	last         time.Time
+	now          func() time.Time
+}
+
+func newTriggerLimiter(max float64, refillPerSec float64) *triggerLimiter {
+	return &triggerLimiter{
+		tokens:       max,
+		max:          max,
+		refillPerSec: refillPerSec,
+		last:         time.Now(),
+		now:          time.Now,
+	}
+}
+
+func (l *triggerLimiter) Allow() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	elapsed := now.Sub(l.last).Seconds()
+	if elapsed > 0 {
+		l.tokens = minFloat64(l.max, l.tokens+elapsed*l.refillPerSec)
+		l.last = now
+	}
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+func minFloat64(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// triggerPriority orders the three trigger lanes for metrics/logging:
+// smaller is processed first when a caller (e.g. a future priority queue in
+// queueProcessorBase) needs to choose among several pending tasks.
+func triggerPriority(t replicationTrigger) int {
+	switch t {
+	case replicationTriggerManual:
+		return 0
+	case replicationTriggerEvent:
+		return 1
+	case replicationTriggerScheduled:
+		return 2
+	default:
+		return 1
+	}
+}
+
+// newDefaultTriggerLimiters builds the per-trigger limiters process() checks
+// before running a task. replicationTriggerManual has no entry: manual tasks
+// bypass rate limiting entirely, per the trigger's doc comment above.
+func newDefaultTriggerLimiters() map[replicationTrigger]*triggerLimiter {
+	return map[replicationTrigger]*triggerLimiter{
+		replicationTriggerEvent:     newTriggerLimiter(1000, 1000),
+		replicationTriggerScheduled: newTriggerLimiter(1, 1),
+	}
+}